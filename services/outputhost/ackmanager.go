@@ -21,7 +21,9 @@
 package outputhost
 
 import (
+	"encoding/binary"
 	"errors"
+	"math/bits"
 	"sync"
 	"time"
 
@@ -37,16 +39,38 @@ import (
 const ackLevelInterval = 5 * time.Second
 const metaContextTimeout = 10 * time.Second
 
+// defaultAckTimeout is how long a message can sit unacked before the
+// checkPending scheduler nacks it on the consumer's behalf, used whenever
+// the consumer group doesn't specify its own lock timeout.
+const defaultAckTimeout = 30 * time.Second
+
+// bitsPerWord is the width of the words backing ackWindow's bitmap.
+const bitsPerWord = 64
+
+// maxPreAcks bounds how many acks we'll buffer for messages that haven't
+// been registered yet (see bufferPreAck), so a misbehaving or very stale
+// client can't grow preAcks without bound.
+const maxPreAcks = 1024
+
+// ackBitmapSnapshotVersion is bumped whenever the wire format of
+// ackBitmapSnapshot changes; decodeAckBitmapSnapshot ignores any version it
+// doesn't recognize, so a rolling deploy with mixed binary versions stays
+// correct (an old outputhost just falls back to redelivering everything).
+const ackBitmapSnapshotVersion = 1
+
+// ackBitmapSnapshotMinLevels is the smallest in-flight window worth
+// snapshotting; below this, redelivering from scratch on restart is cheap
+// enough that persisting a snapshot isn't worth the metadata write.
+const ackBitmapSnapshotMinLevels = 16
+
+// ackBitmapSnapshotMinChange is how far the ack level must have moved since
+// the last snapshot before we bother writing a new one, to avoid churning
+// metadata writes for a window that's barely changed.
+const ackBitmapSnapshotMinChange = 16
+
 type storeHostAddress int64
 
 type (
-	// internalMsg is the message which is stored locally on the ackMgr
-	internalMsg struct {
-		addr  storeHostAddress
-		seq   common.SequenceNumber
-		acked bool
-	}
-
 	levels struct {
 		asOf          common.UnixNanoTime   // Timestamp when this backLogLevel was calculated
 		readLevel     common.SequenceNumber // -1 = nothing received, 0 = 1 message (#0) received, etc.
@@ -58,32 +82,359 @@ type (
 		lastAckedSeq  common.SequenceNumber // the latest sequence which is acked
 	}
 
+	// ackWindow is a compact, growable bitset tracking ack state for the
+	// in-flight window of messages between ackLevel and readLevel. It
+	// replaces a map[SequenceNumber]*internalMsg (one heap-allocated
+	// struct plus map bucket per in-flight message) with a packed bitmap
+	// of acked bits and a parallel slice of store addresses, so advancing
+	// the ack level is a word-at-a-time scan (TrailingZeros64) instead of
+	// a key-by-key map walk.
+	ackWindow struct {
+		base            common.SequenceNumber   // level corresponding to index 0; -1 if nothing tracked yet
+		seqs            []common.SequenceNumber // seqs[i] is the message sequence number at level (base+i)
+		addrs           []storeHostAddress      // addrs[i] is the store address at level (base+i)
+		acked           []uint64                // packed ack bits, one bit per tracked level
+		deliveredAt     []common.UnixNanoTime   // deliveredAt[i] is when (base+i) was last delivered; 0 = no live ack-timeout deadline
+		redeliveryCount []uint32                // redeliveryCount[i] is how many times (base+i) has been redelivered
+	}
+
 	// ackManager is held per CG extent and it holds the addresses that we get from the store.
 	ackManager struct {
-		addrs              map[common.SequenceNumber]*internalMsg // ‡
-		sealed             bool                                   // ‡
-		outputHostUUID     string
-		cgUUID             string
-		extUUID            string
-		connectedStoreUUID *string
-		*levels                    // ‡ the current levels
-		prev               *levels // ‡ the previous levels
-		ackLevelTicker     *time.Ticker
-		closeChannel       chan struct{}
-		waitConsumed       chan<- bool // waitConsumed is the channel which will signal if the extent is completely consumed given by extentCache
-		metaclient         metadata.TChanMetadataService
-		doneWG             sync.WaitGroup
-		logger             bark.Logger
-		sessionID          uint16
-		ackMgrID           uint16              // ID of this ackManager; unique on this host
-		cgCache            *consumerGroupCache // back pointer to the consumer group cache
-		lk                 sync.RWMutex        // ‡ = guarded by this mutex
+		window               ackWindow // ‡
+		sealed               bool      // ‡
+		outputHostUUID       string
+		cgUUID               string
+		extUUID              string
+		connectedStoreUUID   *string
+		*levels                        // ‡ the current levels
+		prev                 *levels   // ‡ the previous levels
+		ackLevelTicker       *time.Ticker
+		ackTimeout           time.Duration       // how long a delivered message can go unacked before it's nacked for redelivery
+		ackTimeoutTimer      *time.Timer         // single timer armed for the earliest pending ack-timeout deadline
+		pendingDeadline      common.UnixNanoTime // ‡ deadline ackTimeoutTimer is currently armed for; 0 = idle
+		closeChannel         chan struct{}
+		waitConsumed         chan<- bool // waitConsumed is the channel which will signal if the extent is completely consumed given by extentCache
+		metaclient           metadata.TChanMetadataService
+		doneWG               sync.WaitGroup
+		logger               bark.Logger
+		sessionID            uint16
+		ackMgrID             uint16                                      // ID of this ackManager; unique on this host
+		cgCache              *consumerGroupCache                         // back pointer to the consumer group cache
+		preAcks              map[common.SequenceNumber]storeHostAddress // ‡ acks received for levels not yet registered via getNextAckID
+		lastSnapshotAckLevel common.SequenceNumber                      // ‡ ackLevel as of the last written ack-bitmap snapshot
+		lk                   sync.RWMutex                                // ‡ = guarded by this mutex
 	}
 )
 
+// newAckWindow returns an empty ackWindow, ready to have levels appended
+// starting from any base level.
+func newAckWindow() ackWindow {
+	return ackWindow{base: -1}
+}
+
+// restore pre-populates an empty ackWindow's acked bitmap from a decoded
+// snapshot, so a message that was already acked before a restart is still
+// known to be acked once it's re-registered via set(), without requiring
+// the client to ack it again. It only sets the base and acked bits; seqs
+// and addrs for these levels are still filled in lazily by set() as each
+// message is actually re-delivered, exactly as for a fresh ackWindow. It
+// must only be called before any level has been set.
+func (w *ackWindow) restore(base common.SequenceNumber, numLevels int, acked []uint64) {
+	if numLevels <= 0 {
+		return
+	}
+	w.base = base
+	w.acked = make([]uint64, (numLevels+bitsPerWord-1)/bitsPerWord)
+	copy(w.acked, acked)
+}
+
+// ackBitmapSnapshot is the schema-versioned, wire form of an ackWindow's
+// acked bitmap, persisted on the ConsumerGroupExtent alongside SetAckOffset
+// so a restarted outputhost can skip redelivering messages that were
+// already acked before the crash, instead of redelivering the whole
+// [ackLevel, readLevel] range.
+type ackBitmapSnapshot struct {
+	version   int16
+	baseSeqNo common.SequenceNumber // the ack level this snapshot was taken at
+	baseAddr  storeHostAddress      // the store address of baseSeqNo, for sanity checking on restore
+	numLevels int32                 // number of levels (bits) covered, i.e. readLevel-ackLevel at snapshot time
+	acked     []uint64
+}
+
+func encodeAckBitmapSnapshot(s ackBitmapSnapshot) []byte {
+	buf := make([]byte, 2+8+8+4+8*len(s.acked))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(s.version))
+	binary.LittleEndian.PutUint64(buf[2:10], uint64(s.baseSeqNo))
+	binary.LittleEndian.PutUint64(buf[10:18], uint64(s.baseAddr))
+	binary.LittleEndian.PutUint32(buf[18:22], uint32(s.numLevels))
+	for i, word := range s.acked {
+		binary.LittleEndian.PutUint64(buf[22+i*8:30+i*8], word)
+	}
+	return buf
+}
+
+// decodeAckBitmapSnapshot parses a snapshot written by encodeAckBitmapSnapshot,
+// returning ok=false for an empty, truncated, or unrecognized-version blob so
+// callers can fall back to redelivering from scratch.
+func decodeAckBitmapSnapshot(data []byte) (s ackBitmapSnapshot, ok bool) {
+	const headerSize = 2 + 8 + 8 + 4
+	if len(data) < headerSize {
+		return
+	}
+	version := int16(binary.LittleEndian.Uint16(data[0:2]))
+	if version != ackBitmapSnapshotVersion {
+		return
+	}
+	numLevels := int32(binary.LittleEndian.Uint32(data[18:22]))
+	numWords := (int(numLevels) + bitsPerWord - 1) / bitsPerWord
+	if numLevels < 0 || len(data) < headerSize+numWords*8 {
+		return
+	}
+	acked := make([]uint64, numWords)
+	for i := range acked {
+		off := headerSize + i*8
+		acked[i] = binary.LittleEndian.Uint64(data[off : off+8])
+	}
+	return ackBitmapSnapshot{
+		version:   version,
+		baseSeqNo: common.SequenceNumber(binary.LittleEndian.Uint64(data[2:10])),
+		baseAddr:  storeHostAddress(binary.LittleEndian.Uint64(data[10:18])),
+		numLevels: numLevels,
+		acked:     acked,
+	}, true
+}
+
+// ensure grows the window so that level can be addressed, setting the base
+// if this is the first level ever tracked.
+func (w *ackWindow) ensure(level common.SequenceNumber) {
+	if w.base < 0 {
+		w.base = level
+	}
+	idx := int(level - w.base)
+	if idx < len(w.seqs) {
+		return
+	}
+	grow := idx + 1 - len(w.seqs)
+	w.seqs = append(w.seqs, make([]common.SequenceNumber, grow)...)
+	w.addrs = append(w.addrs, make([]storeHostAddress, grow)...)
+	w.deliveredAt = append(w.deliveredAt, make([]common.UnixNanoTime, grow)...)
+	w.redeliveryCount = append(w.redeliveryCount, make([]uint32, grow)...)
+	words := idx/bitsPerWord + 1
+	for len(w.acked) < words {
+		w.acked = append(w.acked, 0)
+	}
+}
+
+// set records the sequence number, store address and initial delivery time
+// for the given level, growing the window if necessary.
+func (w *ackWindow) set(level common.SequenceNumber, seq common.SequenceNumber, addr storeHostAddress, deliveredAt common.UnixNanoTime) {
+	w.ensure(level)
+	idx := int(level - w.base)
+	w.seqs[idx] = seq
+	w.addrs[idx] = addr
+	w.deliveredAt[idx] = deliveredAt
+	w.redeliveryCount[idx] = 0
+}
+
+// get returns the sequence number and store address recorded for level, or
+// ok=false if nothing has been recorded there (either never set, or already
+// trimmed away).
+func (w *ackWindow) get(level common.SequenceNumber) (seq common.SequenceNumber, addr storeHostAddress, ok bool) {
+	if level < w.base {
+		return
+	}
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return
+	}
+	return w.seqs[idx], w.addrs[idx], true
+}
+
+// popLast removes level from the window, but only if it is the most
+// recently added entry; used to roll back a level that was never delivered.
+func (w *ackWindow) popLast(level common.SequenceNumber) {
+	idx := int(level - w.base)
+	if idx != len(w.seqs)-1 {
+		return
+	}
+	w.seqs = w.seqs[:idx]
+	w.addrs = w.addrs[:idx]
+	w.deliveredAt = w.deliveredAt[:idx]
+	w.redeliveryCount = w.redeliveryCount[:idx]
+	w.acked[idx/bitsPerWord] &^= 1 << uint(idx%bitsPerWord)
+}
+
+// clearDeadline drops level's live ack-timeout deadline, e.g. because it was
+// just acked or nacked and checkExpired no longer needs to consider it.
+func (w *ackWindow) clearDeadline(level common.SequenceNumber) {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return
+	}
+	w.deliveredAt[idx] = 0
+}
+
+// deadlineAt returns the live ack-timeout deadline for level, or 0 if none
+// is currently armed (never set, or cleared by an ack/nack).
+func (w *ackWindow) deadlineAt(level common.SequenceNumber, ackTimeout time.Duration) common.UnixNanoTime {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) || w.deliveredAt[idx] == 0 {
+		return 0
+	}
+	return w.deliveredAt[idx] + common.UnixNanoTime(ackTimeout.Nanoseconds())
+}
+
+// incrementRedeliveryCount bumps level's redelivery count and returns the
+// new value.
+func (w *ackWindow) incrementRedeliveryCount(level common.SequenceNumber) uint32 {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return 0
+	}
+	w.redeliveryCount[idx]++
+	return w.redeliveryCount[idx]
+}
+
+// redeliveryCountAt returns how many times level has been redelivered.
+func (w *ackWindow) redeliveryCountAt(level common.SequenceNumber) uint32 {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return 0
+	}
+	return w.redeliveryCount[idx]
+}
+
+// ack marks level as acked.
+func (w *ackWindow) ack(level common.SequenceNumber) bool {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return false
+	}
+	w.acked[idx/bitsPerWord] |= 1 << uint(idx%bitsPerWord)
+	return true
+}
+
+// isAcked reports whether level has been marked acked.
+func (w *ackWindow) isAcked(level common.SequenceNumber) bool {
+	idx := int(level - w.base)
+	if idx < 0 || idx >= len(w.seqs) {
+		return false
+	}
+	return w.acked[idx/bitsPerWord]&(1<<uint(idx%bitsPerWord)) != 0
+}
+
+// ackRange marks every level in [from, to] (inclusive) as acked using
+// whole-word OR operations rather than one bit at a time, so a cumulative
+// ack spanning N levels costs O(N/64) instead of O(N).
+func (w *ackWindow) ackRange(from, to common.SequenceNumber) {
+	if to < from {
+		return
+	}
+	startIdx := int(from - w.base)
+	endIdx := int(to - w.base)
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	if endIdx >= len(w.seqs) {
+		endIdx = len(w.seqs) - 1
+	}
+	for idx := startIdx; idx <= endIdx; {
+		wordIdx := idx / bitsPerWord
+		bitOff := uint(idx % bitsPerWord)
+		bitsLeftInWord := bitsPerWord - int(bitOff)
+		run := endIdx - idx + 1
+		if run >= bitsLeftInWord {
+			w.acked[wordIdx] |= ^uint64(0) << bitOff
+			idx += bitsLeftInWord
+		} else {
+			mask := (^uint64(0) << bitOff) & (^uint64(0) >> uint(bitsPerWord-int(bitOff)-run))
+			w.acked[wordIdx] |= mask
+			idx += run
+		}
+	}
+}
+
+// advance walks forward from "from" (exclusive) through "limit" (inclusive)
+// and returns the new level reached by the longest contiguous run of acked
+// messages. Within each word it uses TrailingZeros64 on the inverted word
+// to find the run length in one instruction instead of testing bit by bit.
+func (w *ackWindow) advance(from, limit common.SequenceNumber) common.SequenceNumber {
+	level := from
+	idx := int(level + 1 - w.base)
+	end := int(limit - w.base)
+	if end >= len(w.seqs) {
+		end = len(w.seqs) - 1
+	}
+	for idx <= end {
+		wordIdx := idx / bitsPerWord
+		bitOff := uint(idx % bitsPerWord)
+		word := w.acked[wordIdx] >> bitOff
+
+		if word&1 == 0 {
+			break
+		}
+
+		run := bits.TrailingZeros64(^word)
+		if maxRun := bitsPerWord - int(bitOff); run > maxRun {
+			run = maxRun
+		}
+		if idx+run-1 > end {
+			run = end - idx + 1
+		}
+
+		level += common.SequenceNumber(run)
+		idx += run
+
+		if run < bitsPerWord-int(bitOff) {
+			break
+		}
+	}
+	return level
+}
+
+// trim drops every level at or below newBase-1, shrinking the window down
+// to just the still-in-flight messages. It re-packs the backing slices
+// rather than merely moving a pointer, since the repacked size is what
+// keeps this structure compact across a long-running ackManager.
+func (w *ackWindow) trim(newBase common.SequenceNumber) {
+	if newBase <= w.base {
+		return
+	}
+	drop := int(newBase - w.base)
+	if drop >= len(w.seqs) {
+		w.base = newBase
+		w.seqs = w.seqs[:0]
+		w.addrs = w.addrs[:0]
+		w.deliveredAt = w.deliveredAt[:0]
+		w.redeliveryCount = w.redeliveryCount[:0]
+		w.acked = w.acked[:0]
+		return
+	}
+
+	newSeqs := make([]common.SequenceNumber, len(w.seqs)-drop)
+	newAddrs := make([]storeHostAddress, len(w.addrs)-drop)
+	newDeliveredAt := make([]common.UnixNanoTime, len(w.deliveredAt)-drop)
+	newRedeliveryCount := make([]uint32, len(w.redeliveryCount)-drop)
+	copy(newSeqs, w.seqs[drop:])
+	copy(newAddrs, w.addrs[drop:])
+	copy(newDeliveredAt, w.deliveredAt[drop:])
+	copy(newRedeliveryCount, w.redeliveryCount[drop:])
+
+	newAcked := make([]uint64, (len(newSeqs)+bitsPerWord-1)/bitsPerWord)
+	for i := range newSeqs {
+		oldIdx := i + drop
+		if w.acked[oldIdx/bitsPerWord]&(1<<uint(oldIdx%bitsPerWord)) != 0 {
+			newAcked[i/bitsPerWord] |= 1 << uint(i%bitsPerWord)
+		}
+	}
+
+	w.base, w.seqs, w.addrs, w.acked = newBase, newSeqs, newAddrs, newAcked
+	w.deliveredAt, w.redeliveryCount = newDeliveredAt, newRedeliveryCount
+}
+
 func newAckManager(cgCache *consumerGroupCache, ackMgrID uint32, outputHostUUID string, cgUUID string, extUUID string, connectedStoreUUID *string, waitConsumedCh chan<- bool, cge *metadata.ConsumerGroupExtent, metaclient metadata.TChanMetadataService, logger bark.Logger) *ackManager {
 	ackMgr := &ackManager{
-		addrs:              make(map[common.SequenceNumber]*internalMsg),
+		window:             newAckWindow(),
 		cgCache:            cgCache,
 		outputHostUUID:     outputHostUUID,
 		cgUUID:             cgUUID,
@@ -93,8 +444,15 @@ func newAckManager(cgCache *consumerGroupCache, ackMgrID uint32, outputHostUUID
 		ackMgrID:           uint16(ackMgrID),  //ackMgrID,
 		metaclient:         metaclient,
 		ackLevelTicker:     time.NewTicker(ackLevelInterval),
+		ackTimeout:         ackTimeoutFromCGDesc(cgCache),
+		ackTimeoutTimer:    time.NewTimer(defaultAckTimeout),
 		waitConsumed:       waitConsumedCh,
 		logger:             logger.WithField(common.TagModule, `ackMgr`),
+		preAcks:            make(map[common.SequenceNumber]storeHostAddress),
+	}
+	// nothing pending yet; idle until the first message is delivered
+	if !ackMgr.ackTimeoutTimer.Stop() {
+		<-ackMgr.ackTimeoutTimer.C
 	}
 
 	// Set the previous levels now, so that on our first update, we will calculate rates correctly
@@ -112,21 +470,60 @@ func newAckManager(cgCache *consumerGroupCache, ackMgrID uint32, outputHostUUID
 		ackLevelAddr:  storeHostAddress(cge.GetAckLevelOffset()),
 		readLevelAddr: storeHostAddress(cge.GetReadLevelOffset()),
 	}
+	ackMgr.lastSnapshotAckLevel = ackMgr.ackLevel
+
+	// restore the pending-ack bitmap from the last persisted snapshot, if any,
+	// so messages that were already acked before a restart aren't redelivered.
+	// baseAddr must also match the ack level's store address recorded on the
+	// extent itself; if it doesn't, the snapshot was taken against a
+	// different ack level than the one we're resuming from and can't be
+	// trusted, so fall back to redelivering from scratch.
+	if raw := cge.GetAckBitmapSnapshot(); len(raw) > 0 {
+		if snapshot, ok := decodeAckBitmapSnapshot(raw); ok && snapshot.baseSeqNo == ackMgr.ackLevel && snapshot.baseAddr == ackMgr.ackLevelAddr {
+			ackMgr.window.restore(snapshot.baseSeqNo+1, int(snapshot.numLevels), snapshot.acked)
+			cgCache.consumerM3Client.UpdateGauge(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrSnapshotBytesRead, int64(len(raw)))
+		}
+	}
 
 	return ackMgr
 }
 
+// ackTimeoutFromCGDesc returns the configured per-consumer-group ack
+// timeout, falling back to defaultAckTimeout if the consumer group hasn't
+// set one. LockTimeoutSeconds is expected on ConsumerGroupDescription the
+// same way MaxDeliveryCount and DeadLetterDestinationUUID are expected for
+// dead-letter routing below, but none of those fields are defined in this
+// checkout: ConsumerGroupDescription and the rest of the metadata thrift
+// schema live in cherami-thrift, which is an external dependency this
+// single-file snapshot does not include. Adding LockTimeoutSeconds to that
+// schema is a prerequisite this change cannot itself deliver.
+func ackTimeoutFromCGDesc(cgCache *consumerGroupCache) time.Duration {
+	if seconds := cgCache.cachedCGDesc.GetLockTimeoutSeconds(); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultAckTimeout
+}
+
 // ackID is a string which is a base64 encoded string
 // First we get the ackID and store the address locally in our data structure
-// for maintaining the ack level
+// for maintaining the ack level.
+//
+// A level registered here may already be acked, if it was restored as
+// already-acked from a pending-ack snapshot (see restore) - i.e. the
+// consumer acked it before the outputhost restarted. getNextAckID does not
+// change its signature to report that on its own, since the real caller of
+// getNextAckID lives outside this checkout and changing this signature
+// would break it without any way to verify the new caller here. Callers
+// that want to know whether the level they just registered was restored as
+// already-acked can check wasRestoredAcked after calling getNextAckID.
 func (ackMgr *ackManager) getNextAckID(address int64, sequence common.SequenceNumber) (ackID string) {
 	ackMgr.lk.Lock()
 	ackMgr.readLevel++ // This means that the first ID is '1'
 	ackMgr.readLevelAddr = storeHostAddress(address)
 
 	var expectedReadLevel common.SequenceNumber
-	if msg, ok := ackMgr.addrs[ackMgr.readLevel]; ok {
-		expectedReadLevel = msg.seq
+	if seq, _, ok := ackMgr.window.get(ackMgr.readLevel); ok {
+		expectedReadLevel = seq
 	} else {
 		expectedReadLevel = sequence
 	}
@@ -159,10 +556,39 @@ func (ackMgr *ackManager) getNextAckID(address int64, sequence common.SequenceNu
 
 	ackID = common.ConstructAckID(ackMgr.sessionID, ackMgr.ackMgrID, uint32(ackMgr.readLevel), address)
 
-	// now store the message in the data structure internally
-	ackMgr.addrs[ackMgr.readLevel] = &internalMsg{
-		addr: storeHostAddress(address),
-		seq:  sequence,
+	// now store the message in the window, and arm the ack-timeout
+	// scheduler so a consumer that never acks gets its message redelivered
+	deliveredAt := common.Now()
+	ackMgr.window.set(ackMgr.readLevel, sequence, storeHostAddress(address), deliveredAt)
+
+	if ackMgr.window.isAcked(ackMgr.readLevel) {
+		// this level was pre-populated as acked by restore() before it was
+		// ever set here, i.e. the consumer acked it before the outputhost
+		// restarted; there's nothing to redeliver or time out.
+		if ackMgr.lastAckedSeq < ackMgr.readLevel {
+			ackMgr.lastAckedSeq = ackMgr.readLevel
+		}
+	} else {
+		ackMgr.armCheckPending(deliveredAt + common.UnixNanoTime(ackMgr.ackTimeout.Nanoseconds()))
+	}
+
+	// a client may have already acked this message before we got a chance to
+	// register it, e.g. on an outputhost restart where it re-sends acks for
+	// messages the new ackManager hasn't re-delivered yet; apply that ack now
+	if preAddr, ok := ackMgr.preAcks[ackMgr.readLevel]; ok {
+		delete(ackMgr.preAcks, ackMgr.readLevel)
+		if preAddr == storeHostAddress(address) {
+			ackMgr.window.ack(ackMgr.readLevel)
+			ackMgr.window.clearDeadline(ackMgr.readLevel)
+			if ackMgr.lastAckedSeq < ackMgr.readLevel {
+				ackMgr.lastAckedSeq = ackMgr.readLevel
+			}
+		} else {
+			ackMgr.logger.WithFields(bark.Fields{
+				`address`:  address,
+				`expected`: preAddr,
+			}).Error(`preAck address does not match!`)
+		}
 	}
 
 	ackMgr.lk.Unlock()
@@ -170,6 +596,157 @@ func (ackMgr *ackManager) getNextAckID(address int64, sequence common.SequenceNu
 	return
 }
 
+// wasRestoredAcked reports whether readLevel is currently marked acked.
+// Called right after getNextAckID has registered readLevel, it is true when
+// restore() pre-populated the level as acked (the consumer acked it before
+// the outputhost restarted) or when a buffered preAck was applied to it, so
+// a caller can use it to skip resending the message to the consumer. This
+// is additive: it does not change getNextAckID's existing signature, so it
+// is safe to add without touching the real (external) caller.
+func (ackMgr *ackManager) wasRestoredAcked(readLevel common.SequenceNumber) bool {
+	ackMgr.lk.RLock()
+	acked := ackMgr.window.isAcked(readLevel)
+	ackMgr.lk.RUnlock()
+	return acked
+}
+
+// bufferPreAck records an ack that arrived for a level above the current
+// readLevel, i.e. a message that hasn't been registered via getNextAckID
+// yet. getNextAckID applies it the moment that level is registered. Callers
+// must hold ackMgr.lk.
+func (ackMgr *ackManager) bufferPreAck(level common.SequenceNumber, addr storeHostAddress) {
+	if level <= ackMgr.ackLevel {
+		return // stale; nothing to apply it to anymore
+	}
+	if _, ok := ackMgr.preAcks[level]; !ok && len(ackMgr.preAcks) >= maxPreAcks {
+		var lowest common.SequenceNumber = -1
+		for l := range ackMgr.preAcks {
+			if lowest == -1 || l < lowest {
+				lowest = l
+			}
+		}
+		delete(ackMgr.preAcks, lowest)
+		ackMgr.cgCache.consumerM3Client.IncCounter(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrPreAckEvicted)
+	}
+	ackMgr.preAcks[level] = addr
+}
+
+// armCheckPending makes sure ackTimeoutTimer will fire at or before
+// deadline; it's a no-op if the timer is already armed for something at
+// least as soon. Callers must hold ackMgr.lk.
+func (ackMgr *ackManager) armCheckPending(deadline common.UnixNanoTime) {
+	if ackMgr.pendingDeadline != 0 && ackMgr.pendingDeadline <= deadline {
+		return
+	}
+	ackMgr.pendingDeadline = deadline
+
+	if !ackMgr.ackTimeoutTimer.Stop() {
+		select {
+		case <-ackMgr.ackTimeoutTimer.C:
+		default:
+		}
+	}
+	d := time.Duration(int64(deadline) - int64(common.Now()))
+	if d < 0 {
+		d = 0
+	}
+	ackMgr.ackTimeoutTimer.Reset(d)
+}
+
+// deadLetterCandidate is a message checkExpired found past its ack timeout
+// and that has also exceeded MaxDeliveryCount, so it needs to be routed to
+// the dead-letter destination rather than redelivered yet again.
+type deadLetterCandidate struct {
+	ackID AckID
+	level common.SequenceNumber
+	seq   common.SequenceNumber
+	addr  storeHostAddress
+}
+
+// checkExpired scans the in-flight window for messages whose ack timeout
+// has elapsed, modeled on the "checkPending" scheduler found in other
+// ack-based consumer protocols. A message that hasn't exceeded
+// MaxDeliveryCount yet is nacked on the consumer's behalf so the existing
+// redelivery cache picks it up, and its redelivery count is bumped for
+// admin visibility. A message that has exceeded MaxDeliveryCount is
+// reported as a dead-letter candidate instead of being nacked forever - a
+// consumer that stops responding (rather than explicitly nacking) must
+// still be dead-lettered, exactly like the acknowledgeMessage nack path.
+// It re-arms the timer for whichever deadline (expired or not) comes next.
+func (ackMgr *ackManager) checkExpired() (expired []AckID, deadLettered []deadLetterCandidate) {
+	ackMgr.lk.Lock()
+	ackMgr.pendingDeadline = 0
+	now := common.Now()
+	var next common.UnixNanoTime
+
+	// Walk the acked bitmap a word at a time, exactly like advance/ackRange,
+	// so a window with long acked runs costs O(words) rather than a
+	// per-level isAcked check for every level between ackLevel and
+	// readLevel; that matters here since the whole window is scanned under
+	// ackMgr.lk held for writing.
+	w := &ackMgr.window
+	startIdx := int(ackMgr.ackLevel + 1 - w.base)
+	endIdx := int(ackMgr.readLevel - w.base)
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	if endIdx >= len(w.seqs) {
+		endIdx = len(w.seqs) - 1
+	}
+
+	for idx := startIdx; idx <= endIdx; {
+		wordIdx := idx / bitsPerWord
+		bitOff := uint(idx % bitsPerWord)
+		word := w.acked[wordIdx] >> bitOff
+
+		if word&1 == 1 {
+			// skip the whole run of already-acked levels in this word.
+			run := bits.TrailingZeros64(^word)
+			if maxRun := bitsPerWord - int(bitOff); run > maxRun {
+				run = maxRun
+			}
+			if idx+run-1 > endIdx {
+				run = endIdx - idx + 1
+			}
+			idx += run
+			continue
+		}
+
+		level := common.SequenceNumber(idx) + w.base
+		deadline := w.deadlineAt(level, ackMgr.ackTimeout)
+		if deadline == 0 {
+			idx++
+			continue // no live deadline: never delivered standalone, or already nacked/acked
+		}
+		if deadline <= now {
+			seq, addr, _ := w.get(level)
+			count := w.incrementRedeliveryCount(level)
+			// re-arm for the redelivery, so a consumer that keeps not acking
+			// keeps timing out until the message reaches MaxDeliveryCount
+			w.deliveredAt[idx] = now
+			if redeliverBy := now + common.UnixNanoTime(ackMgr.ackTimeout.Nanoseconds()); next == 0 || redeliverBy < next {
+				next = redeliverBy
+			}
+			ackID := AckID(common.ConstructAckID(ackMgr.sessionID, ackMgr.ackMgrID, uint32(level), int64(addr)))
+			if ackMgr.exceedsMaxDeliveryCount(count) {
+				deadLettered = append(deadLettered, deadLetterCandidate{ackID: ackID, level: level, seq: seq, addr: addr})
+			} else {
+				expired = append(expired, ackID)
+			}
+		} else if next == 0 || deadline < next {
+			next = deadline
+		}
+		idx++
+	}
+
+	if next != 0 {
+		ackMgr.armCheckPending(next)
+	}
+	ackMgr.lk.Unlock()
+
+	return expired, deadLettered
+}
+
 func (ackMgr *ackManager) stop() {
 	close(ackMgr.closeChannel)
 	ackMgr.doneWG.Wait()
@@ -196,8 +773,8 @@ func (ackMgr *ackManager) getCurrentReadLevel() (addr storeHostAddress, seqNo co
 func (ackMgr *ackManager) resetMsg(offset int64) {
 	ackMgr.lk.Lock()
 	// make sure the address of the current readLevel matches with this offset
-	if addrs, ok := ackMgr.addrs[ackMgr.readLevel]; ok {
-		expectedOffset := int64(addrs.addr)
+	if _, addr, ok := ackMgr.window.get(ackMgr.readLevel); ok {
+		expectedOffset := int64(addr)
 		if expectedOffset != offset {
 			// this should *never* happen and we should panic here because the only way to
 			// get here is only because of memory corruption.
@@ -209,7 +786,7 @@ func (ackMgr *ackManager) resetMsg(offset int64) {
 		} else {
 			// report that we removed a read level
 			ackMgr.cgCache.consumerM3Client.UpdateGauge(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrResetMsg, 1)
-			delete(ackMgr.addrs, ackMgr.readLevel)
+			ackMgr.window.popLast(ackMgr.readLevel)
 			// move the readLevel one below, since this message is not here anymore
 			ackMgr.readLevel--
 		}
@@ -232,21 +809,19 @@ func (ackMgr *ackManager) updateAckLevel() {
 
 	ackMgr.lk.Lock()
 
-	count := 0
-	stop := ackMgr.ackLevel + common.SequenceNumber(int64(len(ackMgr.addrs)))
-
-	// We go through the map here and see if the messages are acked,
-	// moving the acklevel as we go forward.
-	for curr := ackMgr.ackLevel + 1; curr <= stop; curr++ {
-		if addrs, ok := ackMgr.addrs[curr]; ok {
-			if addrs.acked {
-				update = true
-				ackMgr.ackLevel = curr
-				count++
-			} else {
-				break
-			}
+	// Advance the ack level as far as the bitset allows: a word-at-a-time
+	// TrailingZeros64 scan instead of a key-by-key map walk.
+	var count common.SequenceNumber
+	if newAckLevel := ackMgr.window.advance(ackMgr.ackLevel, ackMgr.readLevel); newAckLevel != ackMgr.ackLevel {
+		update = true
+		count = newAckLevel - ackMgr.ackLevel
+		ackMgr.ackLevel = newAckLevel
+		// trim drops ackLevel itself from the window, so record its store
+		// address first
+		if _, addr, ok := ackMgr.window.get(ackMgr.ackLevel); ok {
+			ackMgr.ackLevelAddr = addr
 		}
+		ackMgr.window.trim(ackMgr.ackLevel + 1)
 	}
 
 	// check if the extent can be marked as consumed
@@ -260,11 +835,14 @@ func (ackMgr *ackManager) updateAckLevel() {
 	}
 
 	// check if ackLevel is valid here and get the addr here
-	if _, ok := ackMgr.addrs[ackMgr.ackLevel]; ok {
-		ackMgr.ackLevelAddr = ackMgr.addrs[ackMgr.ackLevel].addr
+	if _, addr, ok := ackMgr.window.get(ackMgr.ackLevel); ok {
+		ackMgr.ackLevelAddr = addr
 	}
 
 	if update {
+		ackLevelSeq, _, _ := ackMgr.window.get(ackMgr.ackLevel)
+		readLevelSeq, _, _ := ackMgr.window.get(ackMgr.readLevel)
+
 		ackMgr.asOf = common.Now()
 		oReq = &metadata.SetAckOffsetRequest{
 			OutputHostUUID:     common.StringPtr(ackMgr.outputHostUUID),
@@ -272,9 +850,28 @@ func (ackMgr *ackManager) updateAckLevel() {
 			ExtentUUID:         common.StringPtr(ackMgr.extUUID),
 			ConnectedStoreUUID: common.StringPtr(*ackMgr.connectedStoreUUID),
 			AckLevelAddress:    common.Int64Ptr(int64(ackMgr.ackLevelAddr)),
-			AckLevelSeqNo:      common.Int64Ptr(int64(ackMgr.addrs[ackMgr.ackLevel].seq)),
+			AckLevelSeqNo:      common.Int64Ptr(int64(ackLevelSeq)),
 			ReadLevelAddress:   common.Int64Ptr(int64(ackMgr.readLevelAddr)),
-			ReadLevelSeqNo:     common.Int64Ptr(int64(ackMgr.addrs[ackMgr.readLevel].seq)),
+			ReadLevelSeqNo:     common.Int64Ptr(int64(readLevelSeq)),
+		}
+
+		// Snapshot the pending-ack bitmap alongside the ack offset, so a
+		// restarted outputhost can skip redelivering messages that were
+		// already acked. Gated by a size threshold (tiny windows are cheap
+		// to redeliver from scratch) and a change threshold (no point
+		// re-snapshotting a window that's barely moved).
+		if inFlight := int(ackMgr.readLevel - ackMgr.ackLevel); inFlight >= ackBitmapSnapshotMinLevels &&
+			ackMgr.ackLevel-ackMgr.lastSnapshotAckLevel >= ackBitmapSnapshotMinChange {
+			snapshot := encodeAckBitmapSnapshot(ackBitmapSnapshot{
+				version:   ackBitmapSnapshotVersion,
+				baseSeqNo: ackMgr.ackLevel,
+				baseAddr:  ackMgr.ackLevelAddr,
+				numLevels: int32(inFlight),
+				acked:     ackMgr.window.acked,
+			})
+			oReq.AckBitmapSnapshot = snapshot
+			ackMgr.lastSnapshotAckLevel = ackMgr.ackLevel
+			ackMgr.cgCache.consumerM3Client.UpdateGauge(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrSnapshotBytesWritten, int64(len(snapshot)))
 		}
 
 		// check if we can set the status as consumed
@@ -295,7 +892,7 @@ func (ackMgr *ackManager) updateAckLevel() {
 		*ackMgr.levels = *ackMgr.prev
 	}
 
-	updatedSize := len(ackMgr.addrs)
+	updatedSize := len(ackMgr.window.seqs)
 	ackMgr.lk.Unlock()
 
 	if update {
@@ -334,7 +931,7 @@ func (ackMgr *ackManager) updateAckLevel() {
 		}
 	}
 
-	// Report the size of the ackMgr map, if greater than 0
+	// Report the size of the ackMgr window, if greater than 0
 	if updatedSize > 0 {
 		ackMgr.cgCache.consumerM3Client.UpdateGauge(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrSize, int64(updatedSize))
 	}
@@ -343,14 +940,20 @@ func (ackMgr *ackManager) updateAckLevel() {
 func (ackMgr *ackManager) acknowledgeMessage(ackID AckID, seqNum uint32, address int64, isNack bool) error {
 	var err error
 	notifyCg := true
+	deadLetter := false
+	level := common.SequenceNumber(seqNum)
+	var seq common.SequenceNumber
+	var addr storeHostAddress
+
 	ackMgr.lk.Lock() // Read lock would be OK in this case (except for a benign race with two simultaneous acks for the same ackID), see below
 	// check if this id is present
-	if addrs, ok := ackMgr.addrs[common.SequenceNumber(seqNum)]; ok {
+	if s, a, ok := ackMgr.window.get(level); ok {
+		seq, addr = s, a
 		// validate the address from the ackID
-		if addrs.addr != storeHostAddress(address) {
+		if addr != storeHostAddress(address) {
 			ackMgr.logger.WithFields(bark.Fields{
 				`address`:  address,
-				`expected`: addrs.addr,
+				`expected`: addr,
 			}).Error(`ack address does not match!`)
 			err = errors.New("address of the ackID doesn't match with ackMgr")
 			notifyCg = false
@@ -358,39 +961,176 @@ func (ackMgr *ackManager) acknowledgeMessage(ackID AckID, seqNum uint32, address
 			if ackMgr.cgCache.cachedCGDesc.GetOwnerEmail() == SmartRetryDisableString {
 				ackMgr.logger.WithFields(bark.Fields{
 					`Address`:     address,
-					`addr`:        addrs.addr,
+					`addr`:        addr,
 					common.TagSeq: seqNum,
 					`isNack`:      isNack,
 				}).Info(`msg ack`)
 			}
 			if !isNack {
-				addrs.acked = true // This is the only place that this field of addrs is changed. It was initially set under a write lock elsewhere, hence we can have a read lock
+				ackMgr.window.ack(level) // ack bits are packed 64 to a word, so setting one needs the write lock taken above
 				// update the last acked sequence, if this is the most recent ack
-				if ackMgr.lastAckedSeq < common.SequenceNumber(seqNum) {
-					ackMgr.lastAckedSeq = common.SequenceNumber(seqNum)
+				if ackMgr.lastAckedSeq < level {
+					ackMgr.lastAckedSeq = level
 				}
+			} else if count := ackMgr.window.incrementRedeliveryCount(level); ackMgr.exceedsMaxDeliveryCount(count) {
+				// this message has been redelivered too many times; route it to the
+				// dead-letter destination instead of cycling it through the cache again
+				deadLetter = true
 			}
+			// the message has been explicitly ack'd or nack'd, so the
+			// checkPending scheduler no longer needs to time it out itself
+			ackMgr.window.clearDeadline(level)
 		}
+	} else if !isNack && level > ackMgr.readLevel {
+		// this message hasn't been (re-)delivered yet; buffer the ack so
+		// getNextAckID can apply it as soon as it is registered, instead of
+		// dropping it and waiting for a redundant redelivery
+		ackMgr.bufferPreAck(level, storeHostAddress(address))
+		notifyCg = false
 	} else {
 		// Update metric to reflect that the sequence number is not found
 		ackMgr.cgCache.consumerM3Client.IncCounter(metrics.ConsConnectionScope, metrics.OutputhostCGAckMgrSeqNotFound)
 	}
 	ackMgr.lk.Unlock()
 
+	if !notifyCg {
+		return err
+	}
+
+	if deadLetter {
+		ackMgr.deadLetterOrNack(ackID, level, seq, addr)
+		return err
+	}
+
 	// Now notify the message cache so that it can update it's state
 	// Note: We explicitly do this outside the lock above to prevent us from
 	// blocking with a lock held
 	// send the ack to the ack channel for the msg cache to cleanup
-	if notifyCg {
-		if isNack {
-			ackMgr.cgCache.nackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
-		} else {
-			ackMgr.cgCache.ackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+	if isNack {
+		ackMgr.cgCache.nackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+	} else {
+		ackMgr.cgCache.ackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+	}
+	return err
+}
+
+// acknowledgeUpTo performs a cumulative ack: every message between the
+// current ackLevel and the given ackID's level is marked acked in a single
+// call, rather than requiring the client to ack each sequence individually.
+// Out-of-order acks still go through acknowledgeMessage; acknowledgeUpTo is
+// an optimization for the common case of a consumer that has fully
+// processed a contiguous range and wants to ack it in one round trip. The
+// bitset backing ackWindow makes this O(words) rather than O(messages).
+//
+// This is the ackManager-side half of the feature: nothing in this
+// checkout's consumer protocol layer (the RPC handler that would decode an
+// incoming cumulative-ack request and call this) is present here, so
+// acknowledgeUpTo has no caller yet. It is kept, rather than dropped, as
+// the entry point that wiring is meant to call.
+func (ackMgr *ackManager) acknowledgeUpTo(ackID AckID, seqNum uint32, address int64) error {
+	level := common.SequenceNumber(seqNum)
+	var err error
+
+	ackMgr.lk.Lock()
+	if _, addr, ok := ackMgr.window.get(level); !ok {
+		err = errors.New("ackID doesn't correspond to a known message")
+	} else if addr != storeHostAddress(address) {
+		ackMgr.logger.WithFields(bark.Fields{
+			`address`:  address,
+			`expected`: addr,
+		}).Error(`cumulative ack address does not match!`)
+		err = errors.New("address of the ackID doesn't match with ackMgr")
+	} else {
+		ackMgr.window.ackRange(ackMgr.ackLevel+1, level)
+		// no per-level clearDeadline here: checkExpired skips acked levels,
+		// so an acked level is never timed out
+		if ackMgr.lastAckedSeq < level {
+			ackMgr.lastAckedSeq = level
 		}
 	}
+	ackMgr.lk.Unlock()
+
+	if err == nil {
+		ackMgr.cgCache.ackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+	}
 	return err
 }
 
+// exceedsMaxDeliveryCount reports whether count has reached the consumer
+// group's configured MaxDeliveryCount; a MaxDeliveryCount of 0 means
+// dead-lettering is disabled for this consumer group. MaxDeliveryCount and
+// DeadLetterDestinationUUID below are read from ConsumerGroupDescription,
+// and publishToDeadLetter is a method of consumerGroupCache; none of them is
+// defined in this file.
+func (ackMgr *ackManager) exceedsMaxDeliveryCount(count uint32) bool {
+	maxDeliveryCount := ackMgr.cgCache.cachedCGDesc.GetMaxDeliveryCount()
+	return maxDeliveryCount > 0 && int64(count) >= int64(maxDeliveryCount)
+}
+
+// publishDeadLetter forwards the original message, identified by its store
+// address and sequence number, to the consumer group's configured
+// dead-letter destination via cgCache's inputhost client.
+func (ackMgr *ackManager) publishDeadLetter(seq common.SequenceNumber, addr storeHostAddress) error {
+	dlqUUID := ackMgr.cgCache.cachedCGDesc.GetDeadLetterDestinationUUID()
+	if len(dlqUUID) == 0 {
+		return errors.New("consumer group has no dead-letter destination configured")
+	}
+
+	ctx, cancel := thrift.NewContext(metaContextTimeout)
+	defer cancel()
+
+	return ackMgr.cgCache.publishToDeadLetter(ctx, dlqUUID, ackMgr.extUUID, int64(addr), int64(seq))
+}
+
+// deadLetterOrNack publishes level to the consumer group's dead-letter
+// destination and marks it locally acked so the ack level can advance past
+// it, whether it was discovered via an explicit client nack (acknowledgeMessage)
+// or via the checkPending scheduler timing it out (checkExpired). If
+// publishing fails it falls back to a normal nack so the message is retried
+// rather than lost.
+func (ackMgr *ackManager) deadLetterOrNack(ackID AckID, level common.SequenceNumber, seq common.SequenceNumber, addr storeHostAddress) {
+	if pubErr := ackMgr.publishDeadLetter(seq, addr); pubErr != nil {
+		ackMgr.logger.WithFields(bark.Fields{
+			common.TagErr: pubErr,
+			common.TagSeq: seq,
+		}).Error(`failed to publish dead-lettered message; falling back to nack`)
+		ackMgr.cgCache.nackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+		return
+	}
+
+	ackMgr.cgCache.consumerM3Client.IncCounter(metrics.ConsConnectionScope, metrics.OutputhostCGDeadLettered)
+	ackMgr.logger.WithFields(bark.Fields{
+		common.TagExt: ackMgr.extUUID,
+		common.TagSeq: seq,
+		`ackID`:       ackID,
+	}).Info(`message dead-lettered after exceeding max delivery count`)
+
+	ackMgr.lk.Lock()
+	ackMgr.window.ack(level)
+	if ackMgr.lastAckedSeq < level {
+		ackMgr.lastAckedSeq = level
+	}
+	ackMgr.lk.Unlock()
+
+	// treat it as acked locally so ackLevel can advance past it
+	ackMgr.cgCache.ackMsgCh <- timestampedAckID{AckID: ackID, ts: common.Now()}
+}
+
+// processExpired delivers the results of a checkExpired call: nacking
+// plain-expired messages and dead-lettering (or falling back to nacking)
+// the rest. It runs on its own goroutine, off manageAckLevel's, since both
+// the nackMsgCh/ackMsgCh sends and the dead-letter-publish RPC inside
+// deadLetterOrNack can block.
+func (ackMgr *ackManager) processExpired(expired []AckID, deadLettered []deadLetterCandidate) {
+	defer ackMgr.doneWG.Done()
+	for _, expiredID := range expired {
+		ackMgr.cgCache.nackMsgCh <- timestampedAckID{AckID: expiredID, ts: common.Now()}
+	}
+	for _, dl := range deadLettered {
+		ackMgr.deadLetterOrNack(dl.ackID, dl.level, dl.seq, dl.addr)
+	}
+}
+
 func (ackMgr *ackManager) manageAckLevel() {
 	defer ackMgr.doneWG.Done()
 	// this needs to look at all the acked messages and update the ackLevel
@@ -399,9 +1139,22 @@ func (ackMgr *ackManager) manageAckLevel() {
 		select {
 		case <-ackMgr.ackLevelTicker.C:
 			ackMgr.updateAckLevel()
+		case <-ackMgr.ackTimeoutTimer.C:
+			expired, deadLettered := ackMgr.checkExpired()
+			if len(expired) > 0 || len(deadLettered) > 0 {
+				// nackMsgCh/ackMsgCh sends can block, and deadLetterOrNack
+				// can additionally make a bounded dead-letter-publish RPC;
+				// none of that should stall this goroutine, since it's also
+				// what drives updateAckLevel and the ack-timeout scheduler.
+				// Hand it off to its own goroutine, tracked by doneWG so
+				// stop() still waits for it to drain.
+				ackMgr.doneWG.Add(1)
+				go ackMgr.processExpired(expired, deadLettered)
+			}
 		case <-ackMgr.closeChannel:
 			// before returning make sure we try to set the ack offset
 			ackMgr.updateAckLevel()
+			ackMgr.ackTimeoutTimer.Stop()
 			return
 		}
 	}
@@ -409,14 +1162,13 @@ func (ackMgr *ackManager) manageAckLevel() {
 
 // get the number of acked and unacked messages from the last ack level
 func (ackMgr *ackManager) getNumAckedAndUnackedMessages() (*int64, *int64) {
-	stop := ackMgr.ackLevel + common.SequenceNumber(int64(len(ackMgr.addrs)))
+	stop := ackMgr.readLevel
 
 	var acked int64
 	var unacked int64
-	// We go through the map here and see if the messages are acked,
 	for curr := ackMgr.ackLevel + 1; curr <= stop; curr++ {
-		if addrs, ok := ackMgr.addrs[curr]; ok {
-			if addrs.acked {
+		if _, _, ok := ackMgr.window.get(curr); ok {
+			if ackMgr.window.isAcked(curr) {
 				acked++
 			} else {
 				unacked++
@@ -444,6 +1196,20 @@ func (ackMgr *ackManager) getAckMgrState() *admin.AckMgrState {
 	ackMgrState.LastAckLevelUpdateTime = common.Int64Ptr(int64(ackMgr.asOf))
 	ackMgrState.LastAckedSeq = common.Int64Ptr(int64(ackMgr.lastAckedSeq))
 	ackMgrState.NumAckedMsgs, ackMgrState.NumUnackedMsgs = ackMgr.getNumAckedAndUnackedMessages()
+	ackMgrState.MaxRedeliveryCount = common.Int64Ptr(ackMgr.maxRedeliveryCount())
 
 	return ackMgrState
 }
+
+// maxRedeliveryCount returns the highest per-message redelivery count
+// currently in the in-flight window, for admin visibility into consumers
+// that are repeatedly failing to ack. Callers must hold ackMgr.lk.
+func (ackMgr *ackManager) maxRedeliveryCount() int64 {
+	var max uint32
+	for level := ackMgr.ackLevel + 1; level <= ackMgr.readLevel; level++ {
+		if c := ackMgr.window.redeliveryCountAt(level); c > max {
+			max = c
+		}
+	}
+	return int64(max)
+}
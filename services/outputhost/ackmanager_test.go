@@ -0,0 +1,278 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package outputhost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uber/cherami-server/common"
+)
+
+// newTestAckManager builds an ackManager suitable for exercising the
+// preAck-buffering path directly, without the real consumerGroupCache,
+// metaclient or thrift types that newAckManager needs - those aren't
+// touched by bufferPreAck or by getNextAckID as long as the registered
+// sequence number is 0, which sidesteps the discontinuity-detection branch
+// that reports through cgCache's metrics client.
+func newTestAckManager() *ackManager {
+	return &ackManager{
+		window:          newAckWindow(),
+		ackTimeout:      defaultAckTimeout,
+		ackTimeoutTimer: time.NewTimer(time.Hour),
+		preAcks:         make(map[common.SequenceNumber]storeHostAddress),
+		levels:          &levels{readLevel: -1, ackLevel: -1},
+	}
+}
+
+func TestAckWindowSetGet(t *testing.T) {
+	w := newAckWindow()
+	w.set(5, 50, 500, 1)
+	w.set(6, 60, 600, 2)
+
+	if seq, addr, ok := w.get(5); !ok || seq != 50 || addr != 500 {
+		t.Fatalf("get(5) = %v, %v, %v; want 50, 500, true", seq, addr, ok)
+	}
+	if seq, addr, ok := w.get(6); !ok || seq != 60 || addr != 600 {
+		t.Fatalf("get(6) = %v, %v, %v; want 60, 600, true", seq, addr, ok)
+	}
+	if _, _, ok := w.get(7); ok {
+		t.Fatalf("get(7) = ok; want not found")
+	}
+	if _, _, ok := w.get(4); ok {
+		t.Fatalf("get(4) below base = ok; want not found")
+	}
+}
+
+func TestAckWindowAckAndIsAcked(t *testing.T) {
+	w := newAckWindow()
+	w.set(0, 0, 0, 0)
+	w.set(1, 1, 0, 0)
+
+	if w.isAcked(0) || w.isAcked(1) {
+		t.Fatalf("freshly set levels should not be acked")
+	}
+	if !w.ack(0) {
+		t.Fatalf("ack(0) = false; want true")
+	}
+	if !w.isAcked(0) {
+		t.Fatalf("isAcked(0) = false after ack; want true")
+	}
+	if w.isAcked(1) {
+		t.Fatalf("isAcked(1) = true; ack of level 0 should not affect level 1")
+	}
+	if w.ack(5) {
+		t.Fatalf("ack(5) = true for a level never set; want false")
+	}
+}
+
+func TestAckWindowAdvance(t *testing.T) {
+	w := newAckWindow()
+	for i := common.SequenceNumber(0); i < 200; i++ {
+		w.set(i, i, 0, 0)
+	}
+	// ack everything except level 100, spanning multiple words.
+	for i := common.SequenceNumber(0); i < 200; i++ {
+		if i != 100 {
+			w.ack(i)
+		}
+	}
+
+	if got := w.advance(-1, 199); got != 99 {
+		t.Fatalf("advance(-1, 199) = %v; want 99 (blocked by unacked level 100)", got)
+	}
+
+	w.ack(100)
+	if got := w.advance(99, 199); got != 199 {
+		t.Fatalf("advance(99, 199) = %v; want 199 once level 100 is acked", got)
+	}
+}
+
+func TestAckWindowAdvanceStopsAtLimit(t *testing.T) {
+	w := newAckWindow()
+	for i := common.SequenceNumber(0); i < 10; i++ {
+		w.set(i, i, 0, 0)
+		w.ack(i)
+	}
+
+	if got := w.advance(-1, 4); got != 4 {
+		t.Fatalf("advance(-1, 4) = %v; want 4 (capped at limit even though more is acked)", got)
+	}
+}
+
+func TestAckWindowAckRange(t *testing.T) {
+	w := newAckWindow()
+	for i := common.SequenceNumber(0); i < 150; i++ {
+		w.set(i, i, 0, 0)
+	}
+
+	w.ackRange(10, 140)
+
+	if w.isAcked(9) || w.isAcked(141) {
+		t.Fatalf("ackRange(10, 140) acked outside its bounds")
+	}
+	for i := common.SequenceNumber(10); i <= 140; i++ {
+		if !w.isAcked(i) {
+			t.Fatalf("ackRange(10, 140) did not ack level %v", i)
+		}
+	}
+	if got := w.advance(9, 149); got != 140 {
+		t.Fatalf("advance(9, 149) after ackRange = %v; want 140", got)
+	}
+}
+
+func TestAckWindowTrim(t *testing.T) {
+	w := newAckWindow()
+	for i := common.SequenceNumber(0); i < 10; i++ {
+		w.set(i, i*10, 0, 0)
+	}
+	w.ack(3)
+	w.ack(7)
+
+	w.trim(5)
+
+	if _, _, ok := w.get(4); ok {
+		t.Fatalf("get(4) after trim(5) = ok; want trimmed away")
+	}
+	if seq, _, ok := w.get(5); !ok || seq != 50 {
+		t.Fatalf("get(5) after trim(5) = %v, %v; want 50, true", seq, ok)
+	}
+	if w.isAcked(5) {
+		t.Fatalf("isAcked(5) after trim = true; want false (was never acked)")
+	}
+	if !w.isAcked(7) {
+		t.Fatalf("isAcked(7) after trim = false; want true (ack bit should survive trim)")
+	}
+}
+
+func TestAckWindowPopLast(t *testing.T) {
+	w := newAckWindow()
+	w.set(0, 0, 0, 0)
+	w.set(1, 1, 0, 0)
+
+	w.popLast(0) // not the last entry; no-op
+	if _, _, ok := w.get(0); !ok {
+		t.Fatalf("popLast(0) removed a non-last level")
+	}
+
+	w.popLast(1)
+	if _, _, ok := w.get(1); ok {
+		t.Fatalf("popLast(1) did not remove the last level")
+	}
+}
+
+func TestBufferPreAckAppliedOnRegister(t *testing.T) {
+	ackMgr := newTestAckManager()
+
+	ackMgr.lk.Lock()
+	ackMgr.bufferPreAck(0, 100)
+	ackMgr.lk.Unlock()
+
+	ackMgr.getNextAckID(100, 0)
+
+	if !ackMgr.window.isAcked(0) {
+		t.Fatalf("level 0 should be acked from the buffered preAck")
+	}
+	if ackMgr.lastAckedSeq != 0 {
+		t.Fatalf("lastAckedSeq = %v; want 0", ackMgr.lastAckedSeq)
+	}
+	if _, ok := ackMgr.preAcks[0]; ok {
+		t.Fatalf("preAck for level 0 should have been consumed once applied")
+	}
+}
+
+func TestBufferPreAckIgnoresStaleLevel(t *testing.T) {
+	ackMgr := newTestAckManager()
+	ackMgr.ackLevel = 5
+
+	ackMgr.lk.Lock()
+	ackMgr.bufferPreAck(5, 100) // at or below ackLevel; nothing left to apply it to
+	ackMgr.lk.Unlock()
+
+	if _, ok := ackMgr.preAcks[5]; ok {
+		t.Fatalf("bufferPreAck should not buffer an ack for a level at or below ackLevel")
+	}
+}
+
+func TestAckBitmapSnapshotRoundTrip(t *testing.T) {
+	in := ackBitmapSnapshot{
+		version:   ackBitmapSnapshotVersion,
+		baseSeqNo: 42,
+		baseAddr:  7,
+		numLevels: 130,
+		acked:     []uint64{1, 2, 3},
+	}
+
+	out, ok := decodeAckBitmapSnapshot(encodeAckBitmapSnapshot(in))
+	if !ok {
+		t.Fatalf("decodeAckBitmapSnapshot() ok = false; want true")
+	}
+	if out.version != in.version || out.baseSeqNo != in.baseSeqNo || out.baseAddr != in.baseAddr || out.numLevels != in.numLevels {
+		t.Fatalf("decodeAckBitmapSnapshot() = %+v; want %+v", out, in)
+	}
+	if len(out.acked) != len(in.acked) {
+		t.Fatalf("decodeAckBitmapSnapshot() acked = %v; want %v", out.acked, in.acked)
+	}
+	for i := range in.acked {
+		if out.acked[i] != in.acked[i] {
+			t.Fatalf("decodeAckBitmapSnapshot() acked[%d] = %v; want %v", i, out.acked[i], in.acked[i])
+		}
+	}
+}
+
+func TestDecodeAckBitmapSnapshotRejectsUnknownVersion(t *testing.T) {
+	snapshot := encodeAckBitmapSnapshot(ackBitmapSnapshot{version: ackBitmapSnapshotVersion + 1, numLevels: 0})
+	if _, ok := decodeAckBitmapSnapshot(snapshot); ok {
+		t.Fatalf("decodeAckBitmapSnapshot() ok = true for an unrecognized version; want false")
+	}
+}
+
+func TestDecodeAckBitmapSnapshotRejectsTruncated(t *testing.T) {
+	if _, ok := decodeAckBitmapSnapshot([]byte{1, 2, 3}); ok {
+		t.Fatalf("decodeAckBitmapSnapshot() ok = true for a truncated blob; want false")
+	}
+}
+
+func TestGetNextAckIDSkipsRedeliveryForRestoredAck(t *testing.T) {
+	ackMgr := newTestAckManager()
+	ackMgr.ackLevel = 9
+	ackMgr.readLevel = 9
+
+	// simulate what newAckManager does on restart: restore a snapshot
+	// covering levels 10-11 where level 10 was already acked.
+	ackMgr.window.restore(10, 2, []uint64{0x1})
+
+	ackID := ackMgr.getNextAckID(500, 10)
+	if ackID == "" {
+		t.Fatalf("getNextAckID() returned an empty ackID")
+	}
+	if !ackMgr.wasRestoredAcked(10) {
+		t.Fatalf("wasRestoredAcked(10) = false for a level restored as acked; want true")
+	}
+	if ackMgr.lastAckedSeq != 10 {
+		t.Fatalf("lastAckedSeq = %v; want 10", ackMgr.lastAckedSeq)
+	}
+
+	ackMgr.getNextAckID(500, 11)
+	if ackMgr.wasRestoredAcked(11) {
+		t.Fatalf("wasRestoredAcked(11) = true for a level restored as NOT acked; want false")
+	}
+}